@@ -2,6 +2,6 @@ module github.com/gettrustid/dcid-sdk-examples/backend-server/golang
 
 go 1.21
 
-require github.com/gettrustid/dcid-server-sdk/golang v0.1.0
+require github.com/gettrustid/dcid-server-sdk/golang v0.2.0
 
 replace github.com/gettrustid/dcid-server-sdk/golang => ../../../dcid-backend-sdk/golang
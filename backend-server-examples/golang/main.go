@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -12,31 +17,281 @@ import (
 	"github.com/gettrustid/dcid-server-sdk/golang/pkg/dcid"
 )
 
+// Non-standard status (nginx convention) for a client that closed the
+// connection before the response was written
+const statusClientClosedRequest = 499
+
+// CORS response values, shared by preflight and regular responses
+const (
+	corsAllowMethods  = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Authorization, X-API-Key, X-Refresh-Token, X-Request-ID"
+	corsExposeHeaders = "X-Token-Refreshed, X-Access-Token, X-Refresh-Token, X-Request-ID"
+	corsMaxAge        = "600"
+)
+
+// Largest request body the auto-refresh middleware keeps for a retry
+const maxRequestBodyBytes = 1 << 20
+
+// Longest inbound X-Request-ID that is kept instead of replaced
+const maxRequestIDLength = 128
+
+// Context key for an SDK client that overrides the request's bearer token
+type clientContextKey struct{}
+
+// Handler that returns SDK errors instead of writing them, so the
+// middleware chain can retry, classify and log them. A handler must not
+// write to w before returning a non-nil error.
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+// Response writer that captures the status code for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Returns the wrapped writer, so optional interfaces such as http.Flusher
+// stay available to callers that use http.ResponseController
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
 type Server struct {
-	sdk *dcid.Client
+	sdk            *dcid.Client
+	requestTimeout time.Duration
+	corsOrigins    map[string]bool
+	logger         *slog.Logger
 }
 
-// CORS middleware
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+// CORS middleware - echoes the request Origin only when it is in the
+// allowlist; a "*" entry allows any origin without credentials
+func (s *Server) corsMiddleware(next apiHandler) apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		origin := r.Header.Get("Origin")
+		allowed := false
+
+		// The response depends on Origin unless every origin gets "*"
+		if len(s.corsOrigins) != 1 || !s.corsOrigins["*"] {
+			w.Header().Add("Vary", "Origin")
+		}
 
-		if r.Method == "OPTIONS" {
+		if origin != "" {
+			switch {
+			case s.corsOrigins[origin]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				allowed = true
+			case s.corsOrigins["*"]:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				allowed = true
+			}
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+
+		if r.Method == http.MethodOptions {
+			if allowed {
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			}
 			w.WriteHeader(http.StatusOK)
-			return
+			return nil
 		}
 
-		next(w, r)
+		return next(w, r)
 	}
 }
 
+// Logging middleware - assigns a request ID (or keeps the inbound
+// X-Request-ID), writes the error response for a failed handler and
+// logs one JSON line per request
+func (s *Server) loggingMiddleware(next apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		err := next(rec, r)
+
+		var errAttrs []slog.Attr
+		if err != nil {
+			classified := s.handleError(err)
+			writeError(rec, classified)
+			errAttrs = []slog.Attr{
+				slog.String("error_type", classified.Type),
+				slog.Int("error_status", classified.Status),
+				slog.String("error", err.Error()),
+			}
+			if rec.status == 0 {
+				rec.status = classified.Status
+			}
+		}
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", requestID),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+		}
+		level := slog.LevelInfo
+		if err != nil {
+			attrs = append(attrs, errAttrs...)
+			level = slog.LevelError
+		}
+
+		s.logger.LogAttrs(r.Context(), level, "request", attrs...)
+	}
+}
+
+// Helper to check that an inbound request ID is safe to echo and log:
+// non-empty, at most maxRequestIDLength bytes and printable ASCII only
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper to generate a random (version 4) UUID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Helper to parse a comma-separated origin allowlist
+func parseCORSOrigins(value string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// Timeout middleware - derives a per-request deadline from the request
+// context, which is also cancelled when the client disconnects
+func (s *Server) timeoutMiddleware(next apiHandler) apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		defer cancel()
+
+		return next(w, r.WithContext(ctx))
+	}
+}
+
+// Auto-refresh middleware - when the handler fails with a user token
+// AuthenticationError and the request carries an X-Refresh-Token header,
+// refreshes the tokens and replays the handler once with the new client.
+// The new access token is returned in the X-Access-Token response header,
+// and X-Refresh-Token is set when the backend rotated the refresh token.
+func (s *Server) withAutoRefresh(next apiHandler) apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		refreshToken := r.Header.Get("X-Refresh-Token")
+		if refreshToken == "" {
+			return next(w, r)
+		}
+
+		// Keep the body so the handler can read it again on retry
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return nil
+			}
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return nil
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		err = next(w, r)
+		var authErr *dcid.AuthenticationError
+		if !errors.As(err, &authErr) || authErr.IsAPIKeyError {
+			return err
+		}
+
+		tokens, refreshErr := s.sdk.Auth.RefreshTokenContext(r.Context(), dcid.RefreshTokenOptions{RefreshToken: refreshToken})
+		if refreshErr != nil {
+			return err
+		}
+
+		// SetTokens on the scoped clone, so the retry holds both new tokens.
+		// A backend that does not rotate refresh tokens keeps the old one.
+		refreshed := *tokens
+		if refreshed.RefreshToken == "" {
+			refreshed.RefreshToken = refreshToken
+		}
+		client := s.sdk.WithAuthToken(refreshed.AccessToken)
+		client.SetTokens(refreshed)
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		ctx := context.WithValue(r.Context(), clientContextKey{}, client)
+		w.Header().Set("X-Token-Refreshed", "true")
+		w.Header().Set("X-Access-Token", tokens.AccessToken)
+		if tokens.RefreshToken != "" {
+			w.Header().Set("X-Refresh-Token", tokens.RefreshToken)
+		}
+		return next(w, r.WithContext(ctx))
+	}
+}
+
+// Middleware chain shared by every route
+func (s *Server) route(h apiHandler) http.HandlerFunc {
+	return s.loggingMiddleware(s.corsMiddleware(s.timeoutMiddleware(h)))
+}
+
+// Middleware chain for routes that call the SDK with the user's token
+func (s *Server) protected(h apiHandler) http.HandlerFunc {
+	return s.route(s.withAutoRefresh(h))
+}
+
 func main() {
+	// All output is JSON so log pipelines can ingest it
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
 	// Get configuration from environment variables
 	apiKey := os.Getenv("DCID_API_KEY")
 	if apiKey == "" {
-		log.Fatal("DCID_API_KEY environment variable is required")
+		fatal(logger, "DCID_API_KEY environment variable is required")
 	}
 
 	environment := os.Getenv("DCID_ENVIRONMENT")
@@ -49,532 +304,624 @@ func main() {
 		env = dcid.EnvironmentProd
 	}
 
-	// Initialize SDK
-	sdk, err := dcid.NewClient(dcid.Config{
+	// Initialize SDK. The console logger is left off because its plain
+	// text output would interleave with the JSON request log.
+	config := dcid.Config{
 		Environment: env,
 		APIKey:      apiKey,
 		Timeout:     30 * time.Second,
-		Logger:      dcid.NewConsoleLogger(true),
-	})
+	}
+	sdk, err := dcid.NewClient(config)
 	if err != nil {
-		log.Fatalf("Failed to initialize SDK: %v", err)
+		fatal(logger, "Failed to initialize SDK", slog.String("error", err.Error()))
 	}
 
-	server := &Server{sdk: sdk}
+	requestTimeout := config.Timeout
+	if value := os.Getenv("DCID_REQUEST_TIMEOUT"); value != "" {
+		requestTimeout, err = time.ParseDuration(value)
+		if err != nil || requestTimeout <= 0 {
+			fatal(logger, "Invalid DCID_REQUEST_TIMEOUT: must be a positive duration such as 30s", slog.String("value", value))
+		}
+	}
+
+	corsOrigins := parseCORSOrigins(os.Getenv("DCID_CORS_ORIGINS"))
+
+	server := &Server{
+		sdk:            sdk,
+		requestTimeout: requestTimeout,
+		corsOrigins:    corsOrigins,
+		logger:         logger,
+	}
 
 	// Setup routes - Auth (client SDK compatible)
-	http.HandleFunc("/health", corsMiddleware(server.healthHandler))
-	http.HandleFunc("/api/auth/sign-in/initiate", corsMiddleware(server.signInInitiateHandler))
-	http.HandleFunc("/api/auth/sign-in/confirm", corsMiddleware(server.signInConfirmHandler))
-	http.HandleFunc("/api/auth/admin-login", corsMiddleware(server.adminLoginHandler))
-	http.HandleFunc("/api/auth/token/refresh", corsMiddleware(server.tokenRefreshHandler))
+	http.HandleFunc("/health", server.route(server.healthHandler))
+	http.HandleFunc("/api/auth/sign-in/initiate", server.route(server.signInInitiateHandler))
+	http.HandleFunc("/api/auth/sign-in/confirm", server.route(server.signInConfirmHandler))
+	http.HandleFunc("/api/auth/admin-login", server.route(server.adminLoginHandler))
+	http.HandleFunc("/api/auth/token/refresh", server.route(server.tokenRefreshHandler))
 
 	// Identity - Encryption (client SDK compatible)
-	http.HandleFunc("/api/identity/get-encrypted-key", corsMiddleware(server.getEncryptedKeyHandler))
-	http.HandleFunc("/api/identity/generate-encrypted-key", corsMiddleware(server.generateEncryptedKeyHandler))
+	http.HandleFunc("/api/identity/get-encrypted-key", server.protected(server.getEncryptedKeyHandler))
+	http.HandleFunc("/api/identity/generate-encrypted-key", server.protected(server.generateEncryptedKeyHandler))
 
 	// Identity - Issuer
-	http.HandleFunc("/api/identity/issuer/issue-credential", corsMiddleware(server.issueCredentialHandler))
-	http.HandleFunc("/api/identity/issuer/get-credential-offer", corsMiddleware(server.getCredentialOfferHandler))
+	http.HandleFunc("/api/identity/issuer/issue-credential", server.protected(server.issueCredentialHandler))
+	http.HandleFunc("/api/identity/issuer/get-credential-offer", server.protected(server.getCredentialOfferHandler))
 
 	// Identity - IPFS
-	http.HandleFunc("/api/identity/ipfs/store-credential", corsMiddleware(server.storeCredentialHandler))
-	http.HandleFunc("/api/identity/ipfs/retrieve-user-credential", corsMiddleware(server.retrieveUserCredentialHandler))
-	http.HandleFunc("/api/identity/get-all-user-credentials", corsMiddleware(server.getAllUserCredentialsHandler))
+	http.HandleFunc("/api/identity/ipfs/store-credential", server.protected(server.storeCredentialHandler))
+	http.HandleFunc("/api/identity/ipfs/retrieve-user-credential", server.protected(server.retrieveUserCredentialHandler))
+	http.HandleFunc("/api/identity/get-all-user-credentials", server.protected(server.getAllUserCredentialsHandler))
 
 	// Identity - Verification (client SDK compatible)
-	http.HandleFunc("/api/identity/verify/sign-in", corsMiddleware(server.verifySignInHandler))
-	http.HandleFunc("/api/identity/verification/link-store", corsMiddleware(server.linkStoreHandler))
-	http.HandleFunc("/api/identity/verification/callback", corsMiddleware(server.verifyCallbackHandler))
+	http.HandleFunc("/api/identity/verify/sign-in", server.protected(server.verifySignInHandler))
+	http.HandleFunc("/api/identity/verification/link-store", server.protected(server.linkStoreHandler))
+	http.HandleFunc("/api/identity/verification/callback", server.protected(server.verifyCallbackHandler))
 
 	// Analytics
-	http.HandleFunc("/api/analytics/start-session", corsMiddleware(server.startSessionHandler))
-	http.HandleFunc("/api/analytics/end-session", corsMiddleware(server.endSessionHandler))
+	http.HandleFunc("/api/analytics/start-session", server.route(server.startSessionHandler))
+	http.HandleFunc("/api/analytics/end-session", server.route(server.endSessionHandler))
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("===========================================")
-	log.Printf("DCID Server SDK Test Server")
-	log.Printf("===========================================")
-	log.Printf("Environment: %s", environment)
-	log.Printf("Port: %s", port)
-	log.Printf("Health check: http://localhost:%s/health", port)
-	log.Printf("===========================================")
-	log.Printf("Server is running and ready for requests...")
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if len(corsOrigins) == 0 {
+		logger.Warn("DCID_CORS_ORIGINS is empty, browser requests from other origins will be blocked")
+	}
+	if corsOrigins["*"] {
+		logger.Warn("DCID_CORS_ORIGINS allows any origin (*), do not use this in production")
+	}
+
+	logger.Info("DCID Server SDK Test Server is running and ready for requests",
+		slog.String("environment", environment),
+		slog.String("port", port),
+		slog.String("request_timeout", requestTimeout.String()),
+		slog.String("cors_origins", os.Getenv("DCID_CORS_ORIGINS")),
+		slog.String("health_check", "http://localhost:"+port+"/health"),
+	)
+	if err := http.ListenAndServe(":"+port, nil); err != nil {
+		fatal(logger, "Server stopped", slog.String("error", err.Error()))
+	}
+}
+
+// Helper to log a startup error and exit
+func fatal(logger *slog.Logger, msg string, attrs ...any) {
+	logger.Error(msg, attrs...)
+	os.Exit(1)
 }
 
-// Helper to extract and set auth token from request
-func (s *Server) setAuthFromRequest(r *http.Request) {
+// Helper to get an SDK client scoped to the request's bearer token.
+// WithAuthToken returns a clone that shares the HTTP transport, so the
+// shared client is never mutated and tokens cannot leak between
+// concurrent requests. Requests without a token use the shared client.
+func (s *Server) clientFromRequest(r *http.Request) *dcid.Client {
+	if client, ok := r.Context().Value(clientContextKey{}).(*dcid.Client); ok {
+		return client
+	}
+
 	authHeader := r.Header.Get("Authorization")
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		s.sdk.SetAuthToken(token)
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return s.sdk
 	}
+	return s.sdk.WithAuthToken(strings.TrimPrefix(authHeader, "Bearer "))
 }
 
-func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"status":  "ok",
 		"service": "dcid-server-sdk-test-server",
 	})
+	return nil
 }
 
 // ============================================================================
 // AUTH HANDLERS (client SDK compatible)
 // ============================================================================
 
-func (s *Server) signInInitiateHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) signInInitiateHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
 	var req dcid.RegisterOTPOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Auth.RegisterOTP(req)
+	result, err := s.sdk.Auth.RegisterOTPContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) signInConfirmHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) signInConfirmHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
 	var req dcid.ConfirmOTPOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	tokens, err := s.sdk.Auth.ConfirmOTP(req)
+	tokens, err := s.sdk.Auth.ConfirmOTPContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
-	s.sdk.SetTokens(*tokens)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tokens)
+	return nil
 }
 
-func (s *Server) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) adminLoginHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
 	var req dcid.RegisterOTPOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Auth.AdminLogin(req)
+	result, err := s.sdk.Auth.AdminLoginContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) tokenRefreshHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) tokenRefreshHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
 	var req dcid.RefreshTokenOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	tokens, err := s.sdk.Auth.RefreshToken(req)
+	tokens, err := s.sdk.Auth.RefreshTokenContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
-	s.sdk.SetTokens(*tokens)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tokens)
+	return nil
 }
 
 // ============================================================================
 // IDENTITY - ENCRYPTION HANDLERS (client SDK compatible)
 // ============================================================================
 
-func (s *Server) getEncryptedKeyHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getEncryptedKeyHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	var req dcid.GetEncryptedKeyOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Identity.Encryption.GetKey(req)
+	result, err := client.Identity.Encryption.GetKeyContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) generateEncryptedKeyHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) generateEncryptedKeyHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	var req dcid.GenerateEncryptionKeyOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Identity.Encryption.GenerateKey(req)
+	result, err := client.Identity.Encryption.GenerateKeyContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
 // ============================================================================
 // IDENTITY - ISSUER HANDLERS
 // ============================================================================
 
-func (s *Server) issueCredentialHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) issueCredentialHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	var req dcid.IssueCredentialOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Identity.Issuer.IssueCredential(req)
+	result, err := client.Identity.Issuer.IssueCredentialContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) getCredentialOfferHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getCredentialOfferHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	claimId := r.URL.Query().Get("claimId")
 	txId := r.URL.Query().Get("txId")
 
-	result, err := s.sdk.Identity.Issuer.GetCredentialOffer(dcid.GetCredentialOfferOptions{
+	result, err := client.Identity.Issuer.GetCredentialOfferContext(r.Context(), dcid.GetCredentialOfferOptions{
 		ClaimID: claimId,
 		TxID:    txId,
 	})
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
 // ============================================================================
 // IDENTITY - IPFS HANDLERS
 // ============================================================================
 
-func (s *Server) storeCredentialHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) storeCredentialHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	var req dcid.StoreCredentialOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Identity.IPFS.StoreCredential(req)
+	result, err := client.Identity.IPFS.StoreCredentialContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) retrieveUserCredentialHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) retrieveUserCredentialHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	var req dcid.RetrieveUserCredentialOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Identity.IPFS.RetrieveUserCredential(req)
+	result, err := client.Identity.IPFS.RetrieveUserCredentialContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) getAllUserCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getAllUserCredentialsHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	var req dcid.GetAllUserCredentialsOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Identity.IPFS.GetAllUserCredentials(req)
+	result, err := client.Identity.IPFS.GetAllUserCredentialsContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
 // ============================================================================
 // IDENTITY - VERIFICATION HANDLERS (client SDK compatible)
 // ============================================================================
 
-func (s *Server) verifySignInHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) verifySignInHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	var req dcid.VerifySignInOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Identity.Verification.VerifySignIn(req)
+	result, err := client.Identity.Verification.VerifySignInContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) linkStoreHandler(w http.ResponseWriter, r *http.Request) {
-	s.setAuthFromRequest(r)
-
+func (s *Server) linkStoreHandler(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case http.MethodGet:
 		id := r.URL.Query().Get("id")
-		result, err := s.sdk.Identity.Verification.GetLinkStore(dcid.GetLinkStoreOptions{ID: id})
+		client := s.clientFromRequest(r)
+		result, err := client.Identity.Verification.GetLinkStoreContext(r.Context(), dcid.GetLinkStoreOptions{ID: id})
 		if err != nil {
-			s.handleError(w, err)
-			return
+			return err
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
+		return nil
 
 	case http.MethodPost:
 		var req dcid.PostLinkStoreOptions
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-			return
+			return nil
 		}
-		result, err := s.sdk.Identity.Verification.PostLinkStore(req)
+		client := s.clientFromRequest(r)
+		result, err := client.Identity.Verification.PostLinkStoreContext(r.Context(), req)
 		if err != nil {
-			s.handleError(w, err)
-			return
+			return err
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
+		return nil
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
 	}
 }
 
-func (s *Server) verifyCallbackHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) verifyCallbackHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	s.setAuthFromRequest(r)
+	client := s.clientFromRequest(r)
 
 	sessionId := r.URL.Query().Get("sessionId")
 
 	var req dcid.VerifyCallbackOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 	req.SessionID = sessionId
 
-	result, err := s.sdk.Identity.Verification.VerifyCallback(req)
+	result, err := client.Identity.Verification.VerifyCallbackContext(r.Context(), req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
 // ============================================================================
 // ANALYTICS HANDLERS
 // ============================================================================
 
-func (s *Server) startSessionHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) startSessionHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
 	var req dcid.StartSessionOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Analytics.StartSession(&req)
+	result, err := s.sdk.Analytics.StartSessionContext(r.Context(), &req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func (s *Server) endSessionHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) endSessionHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
 	var req dcid.EndSessionOptions
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	result, err := s.sdk.Analytics.EndSession(&req)
+	result, err := s.sdk.Analytics.EndSessionContext(r.Context(), &req)
 	if err != nil {
-		s.handleError(w, err)
-		return
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
 // ============================================================================
 // ERROR HANDLER
 // ============================================================================
 
-func (s *Server) handleError(w http.ResponseWriter, err error) {
-	w.Header().Set("Content-Type", "application/json")
+// Classified error, shared by the error response and the request log
+type classifiedError struct {
+	Type   string
+	Status int
+	Body   map[string]interface{}
+}
+
+// Classifies an SDK error for the error response and the request log
+func (s *Server) handleError(err error) classifiedError {
+	// The client has disconnected, so there is no body to send
+	if errors.Is(err, context.Canceled) {
+		return classifiedError{
+			Type:   "CanceledError",
+			Status: statusClientClosedRequest,
+		}
+	}
 
-	switch e := err.(type) {
-	case *dcid.AuthenticationError:
-		w.WriteHeader(e.StatusCode)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error":        e.Error(),
-			"type":         "AuthenticationError",
-			"isAPIKeyError": e.IsAPIKeyError,
-		})
-	case *dcid.NetworkError:
-		w.WriteHeader(http.StatusBadGateway)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": e.Error(),
-			"type":  "NetworkError",
-			"code":  e.Code,
-		})
-	case *dcid.ServerError:
-		w.WriteHeader(e.StatusCode)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": e.Error(),
-			"type":  "ServerError",
-		})
-	case *dcid.SDKError:
-		w.WriteHeader(e.StatusCode)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": e.Error(),
-			"type":  "SDKError",
-		})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return classifiedError{
+			Type:   "TimeoutError",
+			Status: http.StatusGatewayTimeout,
+			Body: map[string]interface{}{
+				"error": err.Error(),
+				"type":  "TimeoutError",
+			},
+		}
+	}
+
+	// errors.As so SDK errors wrapped with context are still classified
+	var authErr *dcid.AuthenticationError
+	var networkErr *dcid.NetworkError
+	var serverErr *dcid.ServerError
+	var sdkErr *dcid.SDKError
+
+	switch {
+	case errors.As(err, &authErr):
+		return classifiedError{
+			Type:   "AuthenticationError",
+			Status: authErr.StatusCode,
+			Body: map[string]interface{}{
+				"error":         err.Error(),
+				"type":          "AuthenticationError",
+				"isAPIKeyError": authErr.IsAPIKeyError,
+			},
+		}
+	case errors.As(err, &networkErr):
+		return classifiedError{
+			Type:   "NetworkError",
+			Status: http.StatusBadGateway,
+			Body: map[string]interface{}{
+				"error": err.Error(),
+				"type":  "NetworkError",
+				"code":  networkErr.Code,
+			},
+		}
+	case errors.As(err, &serverErr):
+		return classifiedError{
+			Type:   "ServerError",
+			Status: serverErr.StatusCode,
+			Body: map[string]interface{}{
+				"error": err.Error(),
+				"type":  "ServerError",
+			},
+		}
+	case errors.As(err, &sdkErr):
+		return classifiedError{
+			Type:   "SDKError",
+			Status: sdkErr.StatusCode,
+			Body: map[string]interface{}{
+				"error": err.Error(),
+				"type":  "SDKError",
+			},
+		}
 	default:
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": err.Error(),
-			"type":  "UnknownError",
-		})
+		return classifiedError{
+			Type:   "UnknownError",
+			Status: http.StatusInternalServerError,
+			Body: map[string]interface{}{
+				"error": err.Error(),
+				"type":  "UnknownError",
+			},
+		}
 	}
 }
+
+// Writes the classified error response; cancelled requests have no body
+func writeError(w http.ResponseWriter, classified classifiedError) {
+	if classified.Body == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(classified.Status)
+	json.NewEncoder(w).Encode(classified.Body)
+}
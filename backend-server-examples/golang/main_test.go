@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gettrustid/dcid-server-sdk/golang/pkg/dcid"
+)
+
+// Helper to build a Server whose SDK talks to a fake DCID backend
+func newTestServer(t *testing.T, backendURL string) *Server {
+	t.Helper()
+
+	sdk, err := dcid.NewClient(dcid.Config{
+		Environment: dcid.EnvironmentDev,
+		APIKey:      "test-api-key",
+		BaseURL:     backendURL,
+		Timeout:     5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to initialize SDK: %v", err)
+	}
+
+	return &Server{
+		sdk:            sdk,
+		requestTimeout: 5 * time.Second,
+		corsOrigins:    map[string]bool{},
+		logger:         slog.New(slog.NewJSONHandler(io.Discard, nil)),
+	}
+}
+
+func TestConcurrentRequestsUseOwnToken(t *testing.T) {
+	// Fake backend that echoes the Authorization header it receives
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"encryptedKey": r.Header.Get("Authorization"),
+		})
+	}))
+	defer backend.Close()
+
+	s := newTestServer(t, backend.URL)
+	handler := s.protected(s.getEncryptedKeyHandler)
+
+	const requests = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			token := fmt.Sprintf("token-%d", i)
+			req := httptest.NewRequest(http.MethodPost, "/api/identity/get-encrypted-key", strings.NewReader(`{"did":"did:example:123"}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+
+			handler(rec, req)
+
+			if rec.Code != http.StatusOK {
+				errs <- fmt.Errorf("%s: status %d, body %s", token, rec.Code, rec.Body.String())
+				return
+			}
+			var body struct {
+				EncryptedKey string `json:"encryptedKey"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				errs <- fmt.Errorf("%s: invalid response: %v", token, err)
+				return
+			}
+			if body.EncryptedKey != "Bearer "+token {
+				errs <- fmt.Errorf("%s: backend saw %q", token, body.EncryptedKey)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCanceledRequestWritesNoBody(t *testing.T) {
+	received := make(chan struct{})
+	backendCanceled := make(chan struct{})
+
+	// Fake backend that blocks until the SDK abandons the request. The body
+	// is drained so the server notices when the connection is closed.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		close(received)
+		<-r.Context().Done()
+		close(backendCanceled)
+	}))
+	defer backend.Close()
+
+	var logs bytes.Buffer
+	s := newTestServer(t, backend.URL)
+	s.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	handler := s.protected(s.issueCredentialHandler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/api/identity/issuer/issue-credential", strings.NewReader(`{}`)).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		handler(rec, req)
+		close(done)
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend never received the request")
+	}
+
+	// Simulate the client disconnecting
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return after cancellation")
+	}
+	select {
+	case <-backendCanceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend call was not cancelled")
+	}
+
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected no body, got %q", rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "" {
+		t.Errorf("expected no Content-Type, got %q", ct)
+	}
+
+	entry := decodeLogEntry(t, &logs)
+	if entry.ErrorType != "CanceledError" {
+		t.Errorf("logged error_type = %q, want CanceledError", entry.ErrorType)
+	}
+	if entry.Status != statusClientClosedRequest || entry.ErrorStatus != statusClientClosedRequest {
+		t.Errorf("logged status = %d, error_status = %d, want %d", entry.Status, entry.ErrorStatus, statusClientClosedRequest)
+	}
+}
+
+// Request log line written by loggingMiddleware
+type requestLogEntry struct {
+	RequestID   string `json:"request_id"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Status      int    `json:"status"`
+	ErrorType   string `json:"error_type"`
+	ErrorStatus int    `json:"error_status"`
+}
+
+// Helper to decode the single log line captured in logs
+func decodeLogEntry(t *testing.T, logs *bytes.Buffer) requestLogEntry {
+	t.Helper()
+
+	var entry requestLogEntry
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, logs.String())
+	}
+	return entry
+}
+
+func TestLoggingMiddlewareRequestIDAndErrorType(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "network error", err: &dcid.NetworkError{Code: "ECONNREFUSED"}},
+		{name: "wrapped network error", err: fmt.Errorf("issue credential: %w", &dcid.NetworkError{Code: "ECONNREFUSED"})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			s := newTestServer(t, "http://127.0.0.1:0")
+			s.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+			handler := s.route(func(w http.ResponseWriter, r *http.Request) error {
+				return tt.err
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/identity/issuer/issue-credential", nil)
+			req.Header.Set("X-Request-ID", "req-123")
+			rec := httptest.NewRecorder()
+
+			handler(rec, req)
+
+			if got := rec.Header().Get("X-Request-ID"); got != "req-123" {
+				t.Errorf("X-Request-ID = %q, want %q", got, "req-123")
+			}
+			if rec.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+			}
+
+			entry := decodeLogEntry(t, &logs)
+			if entry.RequestID != "req-123" {
+				t.Errorf("logged request_id = %q, want %q", entry.RequestID, "req-123")
+			}
+			if entry.Method != http.MethodPost || entry.Path != "/api/identity/issuer/issue-credential" {
+				t.Errorf("logged %s %s, want POST /api/identity/issuer/issue-credential", entry.Method, entry.Path)
+			}
+			if entry.ErrorType != "NetworkError" {
+				t.Errorf("logged error_type = %q, want NetworkError", entry.ErrorType)
+			}
+			if entry.Status != http.StatusBadGateway || entry.ErrorStatus != http.StatusBadGateway {
+				t.Errorf("logged status = %d, error_status = %d, want 502", entry.Status, entry.ErrorStatus)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddlewareGeneratesRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+	}{
+		{name: "missing", requestID: ""},
+		{name: "too long", requestID: strings.Repeat("a", maxRequestIDLength+1)},
+		{name: "not printable", requestID: "req\x01123"},
+		{name: "contains spaces", requestID: "req 123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "http://127.0.0.1:0")
+			handler := s.route(s.healthHandler)
+
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			if tt.requestID != "" {
+				req.Header.Set("X-Request-ID", tt.requestID)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if got := rec.Header().Get("X-Request-ID"); len(got) != 36 || got == tt.requestID {
+				t.Errorf("expected a generated UUID, got %q", got)
+			}
+		})
+	}
+}
+
+// Fake backend for the auto-refresh tests. A refresh with "good-refresh"
+// returns new tokens, "static-refresh" returns only a new access token;
+// any other call succeeds only with the new access token.
+func newRefreshBackend(t *testing.T, refreshCalls *int32) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			RefreshToken string `json:"refreshToken"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case body.RefreshToken != "":
+			atomic.AddInt32(refreshCalls, 1)
+			switch body.RefreshToken {
+			case "good-refresh":
+				json.NewEncoder(w).Encode(map[string]string{
+					"accessToken":  "new-access",
+					"refreshToken": "new-refresh",
+				})
+			case "static-refresh":
+				json.NewEncoder(w).Encode(map[string]string{"accessToken": "new-access"})
+			default:
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case r.Header.Get("Authorization") == "Bearer new-access":
+			json.NewEncoder(w).Encode(map[string]string{"encryptedKey": "key"})
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+}
+
+// Helper to send an expired-token request through the protected chain
+func sendWithRefreshToken(handler http.HandlerFunc, refreshToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/identity/get-encrypted-key", strings.NewReader(`{"did":"did:example:123"}`))
+	req.Header.Set("Authorization", "Bearer expired-access")
+	req.Header.Set("X-Refresh-Token", refreshToken)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestAutoRefreshRetriesAfterRefresh(t *testing.T) {
+	var refreshCalls int32
+	backend := newRefreshBackend(t, &refreshCalls)
+	defer backend.Close()
+
+	s := newTestServer(t, backend.URL)
+	var calls int32
+	handler := s.protected(func(w http.ResponseWriter, r *http.Request) error {
+		atomic.AddInt32(&calls, 1)
+		return s.getEncryptedKeyHandler(w, r)
+	})
+
+	rec := sendWithRefreshToken(handler, "good-refresh")
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if calls != 2 || refreshCalls != 1 {
+		t.Errorf("handler calls = %d, refresh calls = %d, want 2 and 1", calls, refreshCalls)
+	}
+	if got := rec.Header().Get("X-Token-Refreshed"); got != "true" {
+		t.Errorf("X-Token-Refreshed = %q, want true", got)
+	}
+	if got := rec.Header().Get("X-Access-Token"); got != "new-access" {
+		t.Errorf("X-Access-Token = %q, want new-access", got)
+	}
+	if got := rec.Header().Get("X-Refresh-Token"); got != "new-refresh" {
+		t.Errorf("X-Refresh-Token = %q, want new-refresh", got)
+	}
+}
+
+func TestAutoRefreshWithoutRotationOmitsRefreshHeader(t *testing.T) {
+	var refreshCalls int32
+	backend := newRefreshBackend(t, &refreshCalls)
+	defer backend.Close()
+
+	s := newTestServer(t, backend.URL)
+	rec := sendWithRefreshToken(s.protected(s.getEncryptedKeyHandler), "static-refresh")
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Access-Token"); got != "new-access" {
+		t.Errorf("X-Access-Token = %q, want new-access", got)
+	}
+	if _, ok := rec.Header()["X-Refresh-Token"]; ok {
+		t.Errorf("X-Refresh-Token = %q, want unset", rec.Header().Get("X-Refresh-Token"))
+	}
+}
+
+func TestAutoRefreshFailedRefreshReturnsOriginalError(t *testing.T) {
+	var refreshCalls int32
+	backend := newRefreshBackend(t, &refreshCalls)
+	defer backend.Close()
+
+	s := newTestServer(t, backend.URL)
+	var calls int32
+	handler := s.protected(func(w http.ResponseWriter, r *http.Request) error {
+		atomic.AddInt32(&calls, 1)
+		return s.getEncryptedKeyHandler(w, r)
+	})
+
+	rec := sendWithRefreshToken(handler, "revoked-refresh")
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if calls != 1 || refreshCalls != 1 {
+		t.Errorf("handler calls = %d, refresh calls = %d, want 1 and 1", calls, refreshCalls)
+	}
+	if got := rec.Header().Get("X-Token-Refreshed"); got != "" {
+		t.Errorf("X-Token-Refreshed = %q, want unset", got)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body["type"] != "AuthenticationError" {
+		t.Errorf("error type = %v, want AuthenticationError", body["type"])
+	}
+}
+
+func TestAutoRefreshSkipsAPIKeyError(t *testing.T) {
+	var refreshCalls int32
+	backend := newRefreshBackend(t, &refreshCalls)
+	defer backend.Close()
+
+	s := newTestServer(t, backend.URL)
+	var calls int32
+	handler := s.protected(func(w http.ResponseWriter, r *http.Request) error {
+		atomic.AddInt32(&calls, 1)
+		return &dcid.AuthenticationError{StatusCode: http.StatusUnauthorized, IsAPIKeyError: true}
+	})
+
+	rec := sendWithRefreshToken(handler, "good-refresh")
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if calls != 1 || refreshCalls != 0 {
+		t.Errorf("handler calls = %d, refresh calls = %d, want 1 and 0", calls, refreshCalls)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body["isAPIKeyError"] != true {
+		t.Errorf("isAPIKeyError = %v, want true", body["isAPIKeyError"])
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowlist       string
+		method          string
+		origin          string
+		wantOrigin      string
+		wantCredentials string
+		wantMaxAge      string
+		wantVary        bool
+		wantNext        bool
+	}{
+		{
+			name:            "allowed origin",
+			allowlist:       "http://localhost:3000, https://app.example.com",
+			method:          http.MethodPost,
+			origin:          "https://app.example.com",
+			wantOrigin:      "https://app.example.com",
+			wantCredentials: "true",
+			wantVary:        true,
+			wantNext:        true,
+		},
+		{
+			name:      "disallowed origin",
+			allowlist: "http://localhost:3000",
+			method:    http.MethodPost,
+			origin:    "https://evil.example.com",
+			wantVary:  true,
+			wantNext:  true,
+		},
+		{
+			name:       "wildcard",
+			allowlist:  "*",
+			method:     http.MethodPost,
+			origin:     "https://any.example.com",
+			wantOrigin: "*",
+			wantNext:   true,
+		},
+		{
+			name:       "wildcard in mixed allowlist",
+			allowlist:  "http://localhost:3000, *",
+			method:     http.MethodPost,
+			origin:     "https://any.example.com",
+			wantOrigin: "*",
+			wantVary:   true,
+			wantNext:   true,
+		},
+		{
+			name:            "preflight",
+			allowlist:       "http://localhost:3000",
+			method:          http.MethodOptions,
+			origin:          "http://localhost:3000",
+			wantOrigin:      "http://localhost:3000",
+			wantCredentials: "true",
+			wantMaxAge:      corsMaxAge,
+			wantVary:        true,
+		},
+		{
+			name:      "empty allowlist",
+			allowlist: "",
+			method:    http.MethodPost,
+			origin:    "http://localhost:3000",
+			wantVary:  true,
+			wantNext:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{corsOrigins: parseCORSOrigins(tt.allowlist)}
+			called := false
+			handler := s.corsMiddleware(func(w http.ResponseWriter, r *http.Request) error {
+				called = true
+				return nil
+			})
+
+			req := httptest.NewRequest(tt.method, "/api/identity/get-encrypted-key", nil)
+			req.Header.Set("Origin", tt.origin)
+			rec := httptest.NewRecorder()
+			if err := handler(rec, req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			h := rec.Header()
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := h.Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+			}
+			if got := h.Get("Access-Control-Max-Age"); got != tt.wantMaxAge {
+				t.Errorf("Max-Age = %q, want %q", got, tt.wantMaxAge)
+			}
+			if got := h.Get("Vary") == "Origin"; got != tt.wantVary {
+				t.Errorf("Vary: Origin set = %v, want %v", got, tt.wantVary)
+			}
+			if tt.wantOrigin != "" {
+				if got := h.Get("Access-Control-Allow-Methods"); got != corsAllowMethods {
+					t.Errorf("Allow-Methods = %q, want %q", got, corsAllowMethods)
+				}
+				if got := h.Get("Access-Control-Allow-Headers"); got != corsAllowHeaders {
+					t.Errorf("Allow-Headers = %q, want %q", got, corsAllowHeaders)
+				}
+			} else if got := h.Get("Access-Control-Allow-Methods"); got != "" {
+				t.Errorf("Allow-Methods = %q for a blocked origin, want unset", got)
+			}
+			if called != tt.wantNext {
+				t.Errorf("next called = %v, want %v", called, tt.wantNext)
+			}
+		})
+	}
+}